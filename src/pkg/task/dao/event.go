@@ -0,0 +1,86 @@
+// Copyright Project Harbor Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dao
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ExecutionEventType identifies the kind of lifecycle transition an ExecutionEvent describes
+type ExecutionEventType string
+
+const (
+	// ExecutionEventCreated is published right after a new execution record is created
+	ExecutionEventCreated ExecutionEventType = "ExecutionCreated"
+	// ExecutionEventStatusChanged is published whenever an execution transits to a different status
+	ExecutionEventStatusChanged ExecutionEventType = "ExecutionStatusChanged"
+	// ExecutionEventCompleted is published when an execution reaches a final status
+	ExecutionEventCompleted ExecutionEventType = "ExecutionCompleted"
+	// ExecutionEventDeleted is published right after an execution record is deleted
+	ExecutionEventDeleted ExecutionEventType = "ExecutionDeleted"
+)
+
+// ExecutionEvent describes a single lifecycle transition of an execution. Subscribers such as
+// the webhook, notification and audit subsystems can react to it instead of polling the DAO
+type ExecutionEvent struct {
+	Type           ExecutionEventType
+	ExecutionID    int64
+	VendorType     string
+	PreviousStatus string
+	Status         string
+	// Metrics is only populated for ExecutionEventCompleted and reflects the final task counts
+	Metrics    *Metrics
+	OccurredAt time.Time
+}
+
+// ExecutionEventBus is implemented by subsystems that want to be notified of execution
+// lifecycle transitions. Publish is called synchronously from the DAO so implementations
+// must not block the caller for long; slow subscribers should hand the event off asynchronously
+type ExecutionEventBus interface {
+	// Publish delivers the event to all subscribers
+	Publish(ctx context.Context, event *ExecutionEvent)
+}
+
+// noopExecutionEventBus is the default bus installed when no subscriber has registered one
+type noopExecutionEventBus struct{}
+
+func (n *noopExecutionEventBus) Publish(_ context.Context, _ *ExecutionEvent) {}
+
+var (
+	executionEventBusMu sync.RWMutex
+	executionEventBus   ExecutionEventBus = &noopExecutionEventBus{}
+)
+
+// SetExecutionEventBus plugs in the bus used to publish execution lifecycle events. Webhook,
+// notification and audit subsystems should call this during initialization so they can react
+// to execution state transitions without polling. Passing nil restores the no-op default
+func SetExecutionEventBus(bus ExecutionEventBus) {
+	if bus == nil {
+		bus = &noopExecutionEventBus{}
+	}
+	executionEventBusMu.Lock()
+	defer executionEventBusMu.Unlock()
+	executionEventBus = bus
+}
+
+func publishExecutionEvent(ctx context.Context, event *ExecutionEvent) {
+	event.OccurredAt = time.Now()
+	executionEventBusMu.RLock()
+	bus := executionEventBus
+	executionEventBusMu.RUnlock()
+	bus.Publish(ctx, event)
+}
@@ -17,6 +17,8 @@ package dao
 import (
 	"context"
 	"fmt"
+	"strings"
+
 	"github.com/goharbor/harbor/src/lib/log"
 
 	"github.com/goharbor/harbor/src/jobservice/job"
@@ -41,9 +43,20 @@ type ExecutionDAO interface {
 	Delete(ctx context.Context, id int64) (err error)
 	// GetMetrics returns the task metrics for the specified execution
 	GetMetrics(ctx context.Context, id int64) (metrics *Metrics, err error)
-	// RefreshStatus refreshes the status of the specified execution according to it's tasks. If it's status
-	// is final, update the end time as well
+	// RefreshStatus refreshes the status of the specified execution according to it's tasks, using the
+	// StatusResolver registered for the execution's vendor type (DefaultStatusResolver if none was
+	// registered). If it's status is final, update the end time as well
 	RefreshStatus(ctx context.Context, id int64) (err error)
+	// GetMetricsBatch returns the task metrics for the specified executions, keyed by execution ID, in a
+	// single SQL aggregation instead of one query per execution
+	GetMetricsBatch(ctx context.Context, ids []int64) (metrics map[int64]*Metrics, err error)
+	// RefreshStatusBatch refreshes the status of the specified executions in a single bulk update,
+	// which is far cheaper than calling RefreshStatus in a loop when a scheduler fans out to many
+	// executions at once (e.g. a replication policy run). Like RefreshStatus, it uses the revision
+	// column for optimistic locking, so an execution concurrently updated through another path is
+	// left untouched by this call rather than clobbered; it isn't retried here and is expected to
+	// be picked up by a later refresh
+	RefreshStatusBatch(ctx context.Context, ids []int64) (err error)
 }
 
 // NewExecutionDAO returns an instance of ExecutionDAO
@@ -84,6 +97,25 @@ func (e *executionDAO) List(ctx context.Context, query *q.Query) ([]*Execution,
 	return executions, nil
 }
 
+// listByIDs fetches the executions with the given ids in a single query, used by
+// RefreshStatusBatch to avoid a per-id round-trip
+func (e *executionDAO) listByIDs(ctx context.Context, ids []int64) ([]*Execution, error) {
+	executions := []*Execution{}
+	if len(ids) == 0 {
+		return executions, nil
+	}
+	qs, err := orm.QuerySetter(ctx, &Execution{}, &q.Query{
+		Keywords: map[string]interface{}{"ID__in": ids},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err = qs.All(&executions); err != nil {
+		return nil, err
+	}
+	return executions, nil
+}
+
 func (e *executionDAO) Get(ctx context.Context, id int64) (*Execution, error) {
 	execution := &Execution{
 		ID: id,
@@ -106,7 +138,17 @@ func (e *executionDAO) Create(ctx context.Context, execution *Execution) (int64,
 	if err != nil {
 		return 0, err
 	}
-	return ormer.Insert(execution)
+	id, err := ormer.Insert(execution)
+	if err != nil {
+		return 0, err
+	}
+	publishExecutionEvent(ctx, &ExecutionEvent{
+		Type:        ExecutionEventCreated,
+		ExecutionID: id,
+		VendorType:  execution.VendorType,
+		Status:      execution.Status,
+	})
+	return id, nil
 }
 
 func (e *executionDAO) Update(ctx context.Context, execution *Execution, props ...string) error {
@@ -114,6 +156,16 @@ func (e *executionDAO) Update(ctx context.Context, execution *Execution, props .
 	if err != nil {
 		return err
 	}
+	// when the status is (possibly) updated, read the previous value first so a status
+	// change event carries an accurate "from" status
+	statusUpdated := len(props) == 0 || containsProp(props, "Status")
+	var previous *Execution
+	if statusUpdated {
+		previous, err = e.Get(ctx, execution.ID)
+		if err != nil {
+			return err
+		}
+	}
 	n, err := ormer.Update(execution, props...)
 	if err != nil {
 		return err
@@ -121,14 +173,54 @@ func (e *executionDAO) Update(ctx context.Context, execution *Execution, props .
 	if n == 0 {
 		return errors.NotFoundError(nil).WithMessage("execution %d not found", execution.ID)
 	}
+	if statusUpdated && previous.Status != execution.Status {
+		// execution is only the caller-supplied partial struct (per props), so the vendor type
+		// must come from the previously fetched full row, not execution.VendorType
+		publishExecutionEvent(ctx, &ExecutionEvent{
+			Type:           ExecutionEventStatusChanged,
+			ExecutionID:    execution.ID,
+			VendorType:     previous.VendorType,
+			PreviousStatus: previous.Status,
+			Status:         execution.Status,
+		})
+		if isFinalStatus(execution.Status) {
+			metrics, err := e.GetMetrics(ctx, execution.ID)
+			if err != nil {
+				return err
+			}
+			publishExecutionEvent(ctx, &ExecutionEvent{
+				Type:        ExecutionEventCompleted,
+				ExecutionID: execution.ID,
+				VendorType:  previous.VendorType,
+				Status:      execution.Status,
+				Metrics:     metrics,
+			})
+		}
+	}
 	return nil
 }
 
+// containsProp returns whether prop is present in props
+func containsProp(props []string, prop string) bool {
+	for _, p := range props {
+		if p == prop {
+			return true
+		}
+	}
+	return false
+}
+
 func (e *executionDAO) Delete(ctx context.Context, id int64) error {
 	ormer, err := orm.FromContext(ctx)
 	if err != nil {
 		return err
 	}
+	// fetch the row before it's gone so the ExecutionEventDeleted event can still carry its
+	// vendor type and last known status
+	previous, err := e.Get(ctx, id)
+	if err != nil {
+		return err
+	}
 	n, err := ormer.Delete(&Execution{
 		ID: id,
 	})
@@ -142,6 +234,12 @@ func (e *executionDAO) Delete(ctx context.Context, id int64) error {
 	if n == 0 {
 		return errors.NotFoundError(nil).WithMessage("execution %d not found", id)
 	}
+	publishExecutionEvent(ctx, &ExecutionEvent{
+		Type:        ExecutionEventDeleted,
+		ExecutionID: id,
+		VendorType:  previous.VendorType,
+		Status:      previous.Status,
+	})
 	return nil
 }
 
@@ -151,32 +249,84 @@ func (e *executionDAO) GetMetrics(ctx context.Context, id int64) (*Metrics, erro
 		return nil, err
 	}
 	metrics := &Metrics{}
-	if len(scs) == 0 {
-		return metrics, nil
+	for _, sc := range scs {
+		applyStatusCount(metrics, sc.Status, sc.Count)
+	}
+	return metrics, nil
+}
+
+func (e *executionDAO) GetMetricsBatch(ctx context.Context, ids []int64) (map[int64]*Metrics, error) {
+	result := make(map[int64]*Metrics, len(ids))
+	if len(ids) == 0 {
+		return result, nil
+	}
+	for _, id := range ids {
+		result[id] = &Metrics{}
 	}
 
-	for _, sc := range scs {
-		switch sc.Status {
-		case job.SuccessStatus.String():
-			metrics.SuccessTaskCount = sc.Count
-		case job.ErrorStatus.String():
-			metrics.ErrorTaskCount = sc.Count
-		case job.PendingStatus.String():
-			metrics.PendingTaskCount = sc.Count
-		case job.RunningStatus.String():
-			metrics.RunningTaskCount = sc.Count
-		case job.ScheduledStatus.String():
-			metrics.ScheduledTaskCount = sc.Count
-		case job.StoppedStatus.String():
-			metrics.StoppedTaskCount = sc.Count
-		default:
-			log.Errorf("unknown task status: %s", sc.Status)
+	ormer, err := orm.FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	placeholders := make([]string, len(ids))
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		placeholders[i] = "?"
+		args[i] = id
+	}
+	sql := fmt.Sprintf(`select execution_id, status, count(*) as count
+			from task
+			where execution_id in (%s)
+			group by execution_id, status`, strings.Join(placeholders, ","))
+	var counts []*executionStatusCount
+	if _, err = ormer.Raw(sql, args...).QueryRows(&counts); err != nil {
+		return nil, err
+	}
+	for _, c := range counts {
+		metrics, ok := result[c.ExecutionID]
+		if !ok {
+			// shouldn't happen as the query is scoped to "ids", be defensive anyway
+			metrics = &Metrics{}
+			result[c.ExecutionID] = metrics
 		}
+		applyStatusCount(metrics, c.Status, c.Count)
+	}
+	return result, nil
+}
+
+// executionStatusCount is the per-execution, per-status task count returned by the
+// "group by execution_id, status" aggregation used by GetMetricsBatch
+type executionStatusCount struct {
+	ExecutionID int64  `orm:"column(execution_id)"`
+	Status      string `orm:"column(status)"`
+	Count       int64  `orm:"column(count)"`
+}
+
+// applyStatusCount accumulates a single (status, count) pair of a task status aggregation
+// into metrics, keeping GetMetrics and GetMetricsBatch consistent
+func applyStatusCount(metrics *Metrics, status string, count int64) {
+	switch status {
+	case job.SuccessStatus.String():
+		metrics.SuccessTaskCount = count
+	case job.ErrorStatus.String():
+		metrics.ErrorTaskCount = count
+	case job.PendingStatus.String():
+		metrics.PendingTaskCount = count
+	case job.RunningStatus.String():
+		metrics.RunningTaskCount = count
+	case job.ScheduledStatus.String():
+		metrics.ScheduledTaskCount = count
+	case job.StoppedStatus.String():
+		metrics.StoppedTaskCount = count
+	case SkippedTaskStatus:
+		metrics.SkippedTaskCount = count
+	default:
+		log.Errorf("unknown task status: %s", status)
+		return
 	}
 	metrics.TaskCount = metrics.SuccessTaskCount + metrics.ErrorTaskCount +
 		metrics.PendingTaskCount + metrics.RunningTaskCount +
-		metrics.ScheduledTaskCount + metrics.StoppedTaskCount
-	return metrics, nil
+		metrics.ScheduledTaskCount + metrics.StoppedTaskCount + metrics.SkippedTaskCount
 }
 func (e *executionDAO) RefreshStatus(ctx context.Context, id int64) error {
 	// as the status of the execution can be refreshed by multiple operators concurrently
@@ -207,16 +357,7 @@ func (e *executionDAO) refreshStatus(ctx context.Context, id int64) (bool, error
 		return false, nil
 	}
 
-	var status string
-	if metrics.PendingTaskCount > 0 || metrics.RunningTaskCount > 0 || metrics.ScheduledTaskCount > 0 {
-		status = job.RunningStatus.String()
-	} else if metrics.ErrorTaskCount > 0 {
-		status = job.ErrorStatus.String()
-	} else if metrics.StoppedTaskCount > 0 {
-		status = job.StoppedStatus.String()
-	} else if metrics.SuccessTaskCount > 0 {
-		status = job.SuccessStatus.String()
-	}
+	status := statusResolverFor(execution.VendorType).Resolve(metrics)
 
 	ormer, err := orm.FromContext(ctx)
 	if err != nil {
@@ -235,6 +376,24 @@ func (e *executionDAO) refreshStatus(ctx context.Context, id int64) (bool, error
 	if n == 0 {
 		return true, nil
 	}
+	if status != execution.Status {
+		publishExecutionEvent(ctx, &ExecutionEvent{
+			Type:           ExecutionEventStatusChanged,
+			ExecutionID:    id,
+			VendorType:     execution.VendorType,
+			PreviousStatus: execution.Status,
+			Status:         status,
+		})
+		if isFinalStatus(status) {
+			publishExecutionEvent(ctx, &ExecutionEvent{
+				Type:        ExecutionEventCompleted,
+				ExecutionID: id,
+				VendorType:  execution.VendorType,
+				Status:      status,
+				Metrics:     metrics,
+			})
+		}
+	}
 
 	/* this is another solution to solve the concurrency issue for refreshing the execution status
 	// set a score for each status:
@@ -281,14 +440,138 @@ func (e *executionDAO) refreshStatus(ctx context.Context, id int64) (bool, error
 	sql = `update execution
 			set end_time = (
 				case
-					when status='%s' or status='%s' or status='%s' then  (
+					when status='%s' or status='%s' or status='%s' or status='%s' or status='%s' then  (
 						select max(end_time)
 						from task
 						where execution_id=?)
 					else NULL
 				end)
 			where id=?`
-	sql = fmt.Sprintf(sql, job.ErrorStatus.String(), job.StoppedStatus.String(), job.SuccessStatus.String())
+	sql = fmt.Sprintf(sql, job.ErrorStatus.String(), job.StoppedStatus.String(), job.SuccessStatus.String(),
+		PartiallySucceededStatus, TimedOutStatus)
 	_, err = ormer.Raw(sql, id, id).Exec()
 	return false, err
 }
+
+// testHookRefreshStatusBatchBeforeExec runs immediately before RefreshStatusBatch issues its bulk
+// update, after it has already read the revisions it will guard the update with. Overridden by
+// tests to simulate a concurrent writer winning the race for one of the rows; always a no-op
+// outside of tests
+var testHookRefreshStatusBatchBeforeExec = func() {}
+
+func isFinalStatus(status string) bool {
+	switch status {
+	case job.ErrorStatus.String(), job.StoppedStatus.String(), job.SuccessStatus.String(),
+		PartiallySucceededStatus, TimedOutStatus:
+		return true
+	default:
+		return false
+	}
+}
+
+// RefreshStatusBatch refreshes the status of many executions in a single bulk update. It computes
+// the per-execution task metrics with one GROUP BY aggregation and, rather than looping RefreshStatus
+// with its per-id optimistic-locking retries, issues a single UPDATE ... FROM (VALUES ...) statement
+// that still carries each execution's revision, so a row concurrently updated by another writer
+// (e.g. a plain RefreshStatus call racing the same execution) is simply left alone instead of
+// being clobbered; its event is skipped for this call and it's picked up by the next refresh
+func (e *executionDAO) RefreshStatusBatch(ctx context.Context, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	rows, err := e.listByIDs(ctx, ids)
+	if err != nil {
+		return err
+	}
+	executions := make(map[int64]*Execution, len(rows))
+	for _, execution := range rows {
+		executions[execution.ID] = execution
+	}
+
+	metricsByID, err := e.GetMetricsBatch(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	ormer, err := orm.FromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	values := make([]string, 0, len(ids))
+	args := make([]interface{}, 0, len(ids)*3)
+	changed := map[int64]*ExecutionEvent{}
+	for _, id := range ids {
+		metrics := metricsByID[id]
+		// no task, nothing to refresh
+		if metrics.TaskCount == 0 {
+			continue
+		}
+		execution, ok := executions[id]
+		if !ok {
+			// the execution was deleted concurrently, nothing to refresh
+			continue
+		}
+		status := statusResolverFor(execution.VendorType).Resolve(metrics)
+		// always issue the row's update, even when the resolved status matches what's already
+		// stored: like refreshStatus, this keeps end_time in sync with the latest task end_time
+		// (e.g. a second failing task landing after the execution is already in Error)
+		values = append(values, "(?, ?, ?)")
+		args = append(args, id, status, execution.Revision)
+		if status != execution.Status {
+			changed[id] = &ExecutionEvent{
+				Type:           ExecutionEventStatusChanged,
+				ExecutionID:    id,
+				VendorType:     execution.VendorType,
+				PreviousStatus: execution.Status,
+				Status:         status,
+			}
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+
+	sql := fmt.Sprintf(`update execution as e
+			set status = v.status,
+				revision = e.revision + 1,
+				end_time = (case when v.status in (?, ?, ?, ?, ?) then
+						(select max(end_time) from task where execution_id = e.id)
+					else NULL end)
+			from (values %s) as v(id, status, revision)
+			where e.id = v.id::bigint and e.revision = v.revision::bigint
+			returning e.id`, strings.Join(values, ","))
+	args = append([]interface{}{
+		job.ErrorStatus.String(), job.StoppedStatus.String(), job.SuccessStatus.String(),
+		PartiallySucceededStatus, TimedOutStatus,
+	}, args...)
+	// test seam: lets tests simulate a write racing in between the revision read above and the
+	// update below. No-op in production
+	testHookRefreshStatusBatchBeforeExec()
+	// the revision guard above silently skips rows whose revision no longer matches (lost the
+	// race to another concurrent writer); "returning e.id" tells us exactly which rows this call
+	// actually updated, so a row a concurrent writer happened to resolve to the same status isn't
+	// mistaken for one this call updated itself
+	var updatedIDs []int64
+	if _, err = ormer.Raw(sql, args...).QueryRows(&updatedIDs); err != nil {
+		return err
+	}
+	for _, id := range updatedIDs {
+		event, ok := changed[id]
+		if !ok {
+			continue
+		}
+		publishExecutionEvent(ctx, event)
+		if isFinalStatus(event.Status) {
+			publishExecutionEvent(ctx, &ExecutionEvent{
+				Type:        ExecutionEventCompleted,
+				ExecutionID: id,
+				VendorType:  event.VendorType,
+				Status:      event.Status,
+				Metrics:     metricsByID[id],
+			})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+// Copyright Project Harbor Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dao
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/goharbor/harbor/src/jobservice/job"
+	"github.com/goharbor/harbor/src/lib/orm"
+	testsuite "github.com/goharbor/harbor/src/testing/suite"
+)
+
+// fakeExecutionEventBus records every event published to it, so tests can assert on the exact
+// payload the DAO handed to ExecutionEventBus.Publish
+type fakeExecutionEventBus struct {
+	events []*ExecutionEvent
+}
+
+func (f *fakeExecutionEventBus) Publish(_ context.Context, event *ExecutionEvent) {
+	f.events = append(f.events, event)
+}
+
+func (f *fakeExecutionEventBus) eventsOfType(t ExecutionEventType) []*ExecutionEvent {
+	var events []*ExecutionEvent
+	for _, event := range f.events {
+		if event.Type == t {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+type executionDAOTestSuite struct {
+	testsuite.Suite
+	dao ExecutionDAO
+}
+
+func (suite *executionDAOTestSuite) SetupSuite() {
+	suite.Suite.SetupSuite()
+	suite.dao = NewExecutionDAO()
+}
+
+func (suite *executionDAOTestSuite) TearDownTest() {
+	suite.ExecSQL("delete from task")
+	suite.ExecSQL("delete from execution")
+	SetExecutionEventBus(nil)
+}
+
+// insertTask inserts a bare task row for the given execution, enough for the status and
+// end_time aggregation queries used by GetMetricsBatch/RefreshStatusBatch
+func (suite *executionDAOTestSuite) insertTask(ctx context.Context, executionID int64, status string, endTime time.Time) {
+	ormer, err := orm.FromContext(ctx)
+	suite.Require().NoError(err)
+	_, err = ormer.Raw(`insert into task (execution_id, status, end_time) values (?, ?, ?)`,
+		executionID, status, endTime).Exec()
+	suite.Require().NoError(err)
+}
+
+// TestUpdatePublishesVendorTypeFromPreviousRow makes sure the ExecutionEventStatusChanged event
+// published by Update carries the execution's real vendor type even when the caller, as the
+// method's contract allows, only supplies the properties it wants updated
+func (suite *executionDAOTestSuite) TestUpdatePublishesVendorTypeFromPreviousRow() {
+	ctx := suite.Context()
+	id, err := suite.dao.Create(ctx, &Execution{
+		VendorType: "REPLICATION",
+		VendorID:   1,
+		Status:     job.PendingStatus.String(),
+		Trigger:    "MANUAL",
+	})
+	suite.Require().NoError(err)
+
+	bus := &fakeExecutionEventBus{}
+	SetExecutionEventBus(bus)
+
+	err = suite.dao.Update(ctx, &Execution{ID: id, Status: job.SuccessStatus.String()}, "Status")
+	suite.Require().NoError(err)
+
+	changed := bus.eventsOfType(ExecutionEventStatusChanged)
+	suite.Require().Len(changed, 1)
+	suite.Equal("REPLICATION", changed[0].VendorType)
+	suite.Equal(job.PendingStatus.String(), changed[0].PreviousStatus)
+	suite.Equal(job.SuccessStatus.String(), changed[0].Status)
+}
+
+// TestRefreshStatusBatch verifies the status of several executions is updated by a single
+// RefreshStatusBatch call
+func (suite *executionDAOTestSuite) TestRefreshStatusBatch() {
+	ctx := suite.Context()
+
+	successID, err := suite.dao.Create(ctx, &Execution{
+		VendorType: "REPLICATION", Status: job.PendingStatus.String(), Trigger: "MANUAL",
+	})
+	suite.Require().NoError(err)
+	suite.insertTask(ctx, successID, job.SuccessStatus.String(), time.Now())
+
+	runningID, err := suite.dao.Create(ctx, &Execution{
+		VendorType: "REPLICATION", Status: job.PendingStatus.String(), Trigger: "MANUAL",
+	})
+	suite.Require().NoError(err)
+	suite.insertTask(ctx, runningID, job.RunningStatus.String(), time.Now())
+
+	bus := &fakeExecutionEventBus{}
+	SetExecutionEventBus(bus)
+
+	err = suite.dao.RefreshStatusBatch(ctx, []int64{successID, runningID})
+	suite.Require().NoError(err)
+
+	refreshed, err := suite.dao.Get(ctx, successID)
+	suite.Require().NoError(err)
+	suite.Equal(job.SuccessStatus.String(), refreshed.Status)
+	suite.NotNil(refreshed.EndTime)
+
+	refreshed, err = suite.dao.Get(ctx, runningID)
+	suite.Require().NoError(err)
+	suite.Equal(job.RunningStatus.String(), refreshed.Status)
+
+	changed := bus.eventsOfType(ExecutionEventStatusChanged)
+	suite.Len(changed, 2)
+}
+
+// TestRefreshStatusBatchRefreshesEndTimeWhenStatusUnchanged makes sure RefreshStatusBatch keeps
+// end_time in sync with the latest task end_time even when the resolved status doesn't change
+// from one call to the next, matching what refreshStatus's unconditional end_time update does
+func (suite *executionDAOTestSuite) TestRefreshStatusBatchRefreshesEndTimeWhenStatusUnchanged() {
+	ctx := suite.Context()
+
+	id, err := suite.dao.Create(ctx, &Execution{
+		VendorType: "REPLICATION", Status: job.PendingStatus.String(), Trigger: "MANUAL",
+	})
+	suite.Require().NoError(err)
+	firstEndTime := time.Now().Add(-time.Hour)
+	suite.insertTask(ctx, id, job.ErrorStatus.String(), firstEndTime)
+
+	suite.Require().NoError(suite.dao.RefreshStatusBatch(ctx, []int64{id}))
+	first, err := suite.dao.Get(ctx, id)
+	suite.Require().NoError(err)
+	suite.Equal(job.ErrorStatus.String(), first.Status)
+	suite.Require().NotNil(first.EndTime)
+
+	// a second failing task lands later, advancing max(task.end_time); the resolved status
+	// ("Error") doesn't change, but end_time should still be kept up to date
+	secondEndTime := time.Now()
+	suite.insertTask(ctx, id, job.ErrorStatus.String(), secondEndTime)
+	suite.Require().NoError(suite.dao.RefreshStatusBatch(ctx, []int64{id}))
+
+	second, err := suite.dao.Get(ctx, id)
+	suite.Require().NoError(err)
+	suite.Equal(job.ErrorStatus.String(), second.Status)
+	suite.Require().NotNil(second.EndTime)
+	suite.True(second.EndTime.After(*first.EndTime),
+		"end_time should have advanced to the newer task's end_time even though status stayed Error")
+}
+
+// TestRefreshStatusBatchSkipsRevisionConflict forces a real revision mismatch at UPDATE time,
+// via testHookRefreshStatusBatchBeforeExec, to verify the optimistic-locking guard added in
+// 626fe8c actually takes effect: a row whose revision changed after RefreshStatusBatch read it
+// but before its bulk UPDATE ran must be left exactly as the concurrent writer set it
+func (suite *executionDAOTestSuite) TestRefreshStatusBatchSkipsRevisionConflict() {
+	ctx := suite.Context()
+
+	id, err := suite.dao.Create(ctx, &Execution{
+		VendorType: "REPLICATION", Status: job.PendingStatus.String(), Trigger: "MANUAL",
+	})
+	suite.Require().NoError(err)
+	suite.insertTask(ctx, id, job.SuccessStatus.String(), time.Now())
+
+	bus := &fakeExecutionEventBus{}
+	SetExecutionEventBus(bus)
+
+	testHookRefreshStatusBatchBeforeExec = func() {
+		// simulate a concurrent writer (e.g. another RefreshStatus call) winning the race for
+		// this execution in between RefreshStatusBatch's revision read and its bulk UPDATE
+		suite.Require().NoError(suite.dao.RefreshStatus(ctx, id))
+	}
+	defer func() { testHookRefreshStatusBatchBeforeExec = func() {} }()
+
+	suite.Require().NoError(suite.dao.RefreshStatusBatch(ctx, []int64{id}))
+
+	refreshed, err := suite.dao.Get(ctx, id)
+	suite.Require().NoError(err)
+	suite.Equal(job.SuccessStatus.String(), refreshed.Status)
+
+	// only the concurrent RefreshStatus call should have published a StatusChanged event; the
+	// batch call lost the optimistic-lock race and must not have published a duplicate
+	changed := bus.eventsOfType(ExecutionEventStatusChanged)
+	suite.Len(changed, 1)
+}
+
+func TestExecutionDAOTestSuite(t *testing.T) {
+	suite.Run(t, &executionDAOTestSuite{})
+}
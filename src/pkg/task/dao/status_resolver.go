@@ -0,0 +1,98 @@
+// Copyright Project Harbor Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dao
+
+import (
+	"sync"
+
+	"github.com/goharbor/harbor/src/jobservice/job"
+)
+
+// aggregate execution statuses beyond the ones jobservice already defines for a single task.
+// these only ever appear as the status of an execution, never of an individual task
+const (
+	// PartiallySucceededStatus means some of the execution's tasks ended in success and some in
+	// error, and the vendor's StatusResolver considers that an acceptable outcome
+	PartiallySucceededStatus = "PartiallySucceeded"
+	// TimedOutStatus means the execution didn't reach a final status before its vendor-defined
+	// deadline elapsed
+	TimedOutStatus = "TimedOut"
+)
+
+// SkippedTaskStatus is a task-level status, counted in Metrics.SkippedTaskCount, for tasks a
+// vendor decided not to run (e.g. GC skipping an artifact that was already removed). Unlike
+// SuccessStatus/ErrorStatus/etc. it isn't defined by jobservice since a skipped task never
+// actually runs as a job
+const SkippedTaskStatus = "Skipped"
+
+// StatusResolver derives the aggregate status of an execution from the status counts of its
+// tasks. The default resolver treats any error task as fatal; vendors that can tolerate partial
+// failure (e.g. GC skipping artifacts already removed) can register their own
+type StatusResolver interface {
+	// Resolve returns the execution status that corresponds to metrics
+	Resolve(metrics *Metrics) string
+}
+
+// defaultStatusResolver reproduces the precedence ExecutionDAO has always used: running while
+// any task is still pending/running/scheduled, otherwise error > stopped > success. A skipped
+// task never blocks completion under the default policy, so it counts toward success the same
+// way a successful one does; vendors that want skipped tasks to mean something else (e.g. fail
+// the execution, or report PartiallySucceededStatus) should register their own resolver
+type defaultStatusResolver struct{}
+
+func (defaultStatusResolver) Resolve(metrics *Metrics) string {
+	switch {
+	case metrics.PendingTaskCount > 0 || metrics.RunningTaskCount > 0 || metrics.ScheduledTaskCount > 0:
+		return job.RunningStatus.String()
+	case metrics.ErrorTaskCount > 0:
+		return job.ErrorStatus.String()
+	case metrics.StoppedTaskCount > 0:
+		return job.StoppedStatus.String()
+	case metrics.SuccessTaskCount > 0 || metrics.SkippedTaskCount > 0:
+		return job.SuccessStatus.String()
+	default:
+		return ""
+	}
+}
+
+// DefaultStatusResolver is the StatusResolver used for vendors that never registered one of
+// their own
+var DefaultStatusResolver StatusResolver = defaultStatusResolver{}
+
+var (
+	statusResolverMu sync.RWMutex
+	statusResolvers  = map[string]StatusResolver{}
+)
+
+// RegisterStatusResolver plugs in the StatusResolver used to aggregate the status of executions
+// created by vendorType (e.g. "REPLICATION", "GC", "PURGE_AUDIT"). It should be called once
+// during the vendor's initialization; registering again for the same vendorType replaces the
+// previous resolver
+func RegisterStatusResolver(vendorType string, resolver StatusResolver) {
+	statusResolverMu.Lock()
+	defer statusResolverMu.Unlock()
+	statusResolvers[vendorType] = resolver
+}
+
+// statusResolverFor returns the StatusResolver registered for vendorType, falling back to
+// DefaultStatusResolver when none was registered
+func statusResolverFor(vendorType string) StatusResolver {
+	statusResolverMu.RLock()
+	defer statusResolverMu.RUnlock()
+	if resolver, ok := statusResolvers[vendorType]; ok {
+		return resolver
+	}
+	return DefaultStatusResolver
+}
@@ -0,0 +1,62 @@
+// Copyright Project Harbor Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dao
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/goharbor/harbor/src/jobservice/job"
+)
+
+func TestDefaultStatusResolverResolve(t *testing.T) {
+	cases := []struct {
+		name    string
+		metrics *Metrics
+		want    string
+	}{
+		{
+			name:    "all skipped",
+			metrics: &Metrics{SkippedTaskCount: 3, TaskCount: 3},
+			want:    job.SuccessStatus.String(),
+		},
+		{
+			name:    "success and skipped",
+			metrics: &Metrics{SuccessTaskCount: 1, SkippedTaskCount: 2, TaskCount: 3},
+			want:    job.SuccessStatus.String(),
+		},
+		{
+			name:    "still running takes precedence over skipped",
+			metrics: &Metrics{RunningTaskCount: 1, SkippedTaskCount: 2, TaskCount: 3},
+			want:    job.RunningStatus.String(),
+		},
+		{
+			name:    "error takes precedence over skipped",
+			metrics: &Metrics{ErrorTaskCount: 1, SkippedTaskCount: 2, TaskCount: 3},
+			want:    job.ErrorStatus.String(),
+		},
+		{
+			name:    "no tasks at all",
+			metrics: &Metrics{},
+			want:    "",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.want, DefaultStatusResolver.Resolve(c.metrics))
+		})
+	}
+}